@@ -0,0 +1,253 @@
+package snowflake_client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+	proxy "git.torproject.org/pluggable-transports/snowflake.git/proxy/lib"
+	"github.com/pion/webrtc/v3"
+)
+
+// dataChannelTimeout is how long collectPeer waits for a proxy to open its
+// data channel before giving up on it, mirroring proxy/lib's own timeout for
+// the same handshake from the other side.
+const dataChannelTimeout = 20 * time.Second
+
+// pollInterval is how long keepCollecting waits after a failed attempt to
+// collect a peer before retrying, so a broken broker or network doesn't
+// turn into a busy loop.
+const pollInterval = 5 * time.Second
+
+// dataChannelConn adapts a webrtc.DataChannel to io.ReadWriteCloser, the
+// same shape proxy/lib's (unexported) webRTCConn gives the proxy side of
+// the data channel.
+type dataChannelConn struct {
+	pc *webrtc.PeerConnection
+	dc *webrtc.DataChannel
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newDataChannelConn(pc *webrtc.PeerConnection, dc *webrtc.DataChannel) *dataChannelConn {
+	pr, pw := io.Pipe()
+	conn := &dataChannelConn{pc: pc, dc: dc, pr: pr, pw: pw, closed: make(chan struct{})}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if _, err := conn.pw.Write(msg.Data); err != nil {
+			conn.pw.CloseWithError(err)
+		}
+	})
+	dc.OnClose(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func (c *dataChannelConn) Read(b []byte) (int, error) { return c.pr.Read(b) }
+
+func (c *dataChannelConn) Write(b []byte) (int, error) {
+	if err := c.dc.Send(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *dataChannelConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.pw.Close()
+		c.dc.Close()
+		c.pc.Close()
+	})
+	return nil
+}
+
+// peer is a single WebRTC connection to one proxy ("snowflake"). Several of
+// these back a client's turbotunnel session at once, so the client can
+// survive any one of them disappearing.
+type peer struct {
+	*dataChannelConn
+}
+
+// peerPool maintains up to max concurrent peers, collecting replacements
+// from the broker as old ones close.
+type peerPool struct {
+	broker *proxy.SignalingServer
+	config webrtc.Configuration
+	max    int
+
+	mutex    sync.Mutex
+	closed   bool
+	peers    map[*peer]struct{}
+	arrived  chan *peer
+	watchers []func(*peer)
+	done     chan struct{}
+}
+
+func newPeerPool(broker *proxy.SignalingServer, config webrtc.Configuration, max int) *peerPool {
+	p := &peerPool{
+		broker:  broker,
+		config:  config,
+		max:     max,
+		peers:   make(map[*peer]struct{}),
+		arrived: make(chan *peer),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < max; i++ {
+		go p.keepCollecting()
+	}
+	return p
+}
+
+// keepCollecting collects one peer at a time, forever, replacing each as it
+// closes. Running max of these concurrently is what keeps up to max peers
+// alive.
+func (p *peerPool) keepCollecting() {
+	for {
+		pr, err := p.collectPeer()
+		if err != nil {
+			log.Printf("snowflake_client: error collecting peer: %s", err)
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			pr.Close()
+			return
+		}
+		p.peers[pr] = struct{}{}
+		watchers := append([]func(*peer){}, p.watchers...)
+		// The send to arrived must happen under the same lock as the
+		// closed check above: Close() also takes this lock before
+		// closing arrived, so holding it here rules out the window
+		// where Close() could close arrived between our check and our
+		// send, which would panic even with the select's default case.
+		select {
+		case p.arrived <- pr:
+		default:
+		}
+		p.mutex.Unlock()
+
+		for _, watch := range watchers {
+			go watch(pr)
+		}
+
+		<-pr.closed
+
+		p.mutex.Lock()
+		delete(p.peers, pr)
+		p.mutex.Unlock()
+	}
+}
+
+// watch registers watch to be called with every peer currently in the pool,
+// and again with every peer that arrives afterwards, so callers that need to
+// fan out over all peers (rather than just grab any one, the way next()
+// does) don't need their own polling loop.
+func (p *peerPool) watch(watch func(*peer)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for pr := range p.peers {
+		go watch(pr)
+	}
+	p.watchers = append(p.watchers, watch)
+}
+
+// collectPeer negotiates a single new WebRTC connection through the broker:
+// it builds an SDP offer using proxy/lib's trickle-ICE helper, polls the
+// broker for a matching proxy and its answer, and waits for the resulting
+// data channel to open.
+func (p *peerPool) collectPeer() (*peer, error) {
+	dataChan := make(chan struct{})
+	pc, dc, err := proxy.NewTricklePeerConnection(p.config, dataChan)
+	if err != nil {
+		return nil, fmt.Errorf("making WebRTC connection: %s", err)
+	}
+
+	offer := pc.LocalDescription()
+	sdp, err := util.SerializeSessionDescription(offer)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("encoding offer: %s", err)
+	}
+
+	sessionID := proxy.GenSessionID()
+	body, err := messages.EncodeClientPollRequest(sessionID, sdp)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("encoding poll request: %s", err)
+	}
+	resp, err := p.broker.Exchange("client", body)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("polling broker: %s", err)
+	}
+	answerSDP, err := messages.DecodeClientPollResponse(resp)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("decoding broker response: %s", err)
+	}
+	answer, err := util.DeserializeSessionDescription(answerSDP)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("decoding answer: %s", err)
+	}
+	if err := pc.SetRemoteDescription(*answer); err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("setting answer: %s", err)
+	}
+
+	select {
+	case <-dataChan:
+	case <-time.After(dataChannelTimeout):
+		pc.Close()
+		return nil, fmt.Errorf("timed out waiting for proxy to open data channel")
+	}
+
+	return &peer{newDataChannelConn(pc, dc)}, nil
+}
+
+// next blocks until a peer is available, returning one of the currently
+// live peers.
+func (p *peerPool) next() (*peer, bool) {
+	p.mutex.Lock()
+	for pr := range p.peers {
+		p.mutex.Unlock()
+		return pr, true
+	}
+	p.mutex.Unlock()
+
+	pr, ok := <-p.arrived
+	return pr, ok
+}
+
+// Done returns a channel that's closed once the pool is closed, so other
+// components built around the pool (such as packetConn's ReadFrom) can stop
+// waiting on it instead of blocking forever.
+func (p *peerPool) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *peerPool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for pr := range p.peers {
+		pr.Close()
+	}
+	close(p.arrived)
+	close(p.done)
+	return nil
+}
@@ -0,0 +1,118 @@
+package snowflake_client
+
+import (
+	"log"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// transportName is the pluggable transport name Tor is configured with in
+// torrc, e.g. "ClientTransportPlugin snowflake exec client -transport snowflake".
+const transportName = "snowflake"
+
+// ClientTransportPlugin runs SnowflakeClient as a goptlib pluggable
+// transport: it does the ClientSetup handshake with the parent process
+// (tor), opens a SOCKS listener on an ephemeral 127.0.0.1 port for each
+// requested "snowflake" method, and for each SOCKS connection dials out through sc, copying bytes
+// between the two until either side closes. It's the client-side
+// counterpart of a standalone proxy binary built on proxy/lib.
+func ClientTransportPlugin(sc *SnowflakeClient) error {
+	ptInfo, err := pt.ClientSetup([]string{transportName})
+	if err != nil {
+		return err
+	}
+
+	if err := sc.Start(); err != nil {
+		pt.CmethodError(transportName, err.Error())
+		return err
+	}
+
+	for _, methodName := range ptInfo.MethodNames {
+		if methodName != transportName {
+			pt.CmethodError(methodName, "no such method")
+			continue
+		}
+		ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+		if err != nil {
+			pt.CmethodError(methodName, err.Error())
+			continue
+		}
+		go acceptLoop(sc, ln)
+		pt.Cmethod(methodName, ln.Version(), ln.Addr())
+	}
+	pt.CmethodsDone()
+
+	<-ptInfo.Shutdown
+	return sc.Close()
+}
+
+func acceptLoop(sc *SnowflakeClient, ln *pt.SocksListener) {
+	defer ln.Close()
+	for {
+		conn, err := ln.AcceptSocks()
+		if err != nil {
+			log.Printf("snowflake_client: SOCKS accept error: %s", err)
+			return
+		}
+		go handleSocks(sc, conn)
+	}
+}
+
+func handleSocks(sc *SnowflakeClient, conn *pt.SocksConn) {
+	defer conn.Close()
+
+	remote, err := sc.Dial("", "")
+	if err != nil {
+		log.Printf("snowflake_client: dial error: %s", err)
+		conn.Reject()
+		return
+	}
+	defer remote.Close()
+
+	if err := conn.Grant(nil); err != nil {
+		log.Printf("snowflake_client: SOCKS grant error: %s", err)
+		return
+	}
+
+	copyLoop(conn, remote)
+}
+
+// copyLoop relays bytes between local and remote until either side closes,
+// the same shape proxy/lib uses for its own client<->relay copy loop.
+func copyLoop(local, remote interface {
+	Read([]byte) (int, error)
+	Write([]byte) (int, error)
+}) {
+	done := make(chan struct{}, 2)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := remote.Read(buf)
+			if n > 0 {
+				if _, werr := local.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := local.Read(buf)
+			if n > 0 {
+				if _, werr := remote.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	<-done
+}
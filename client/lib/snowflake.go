@@ -0,0 +1,120 @@
+// Package snowflake_client is a companion to proxy/lib: where proxy/lib lets
+// an application embed a Snowflake proxy, this package lets an application
+// embed a Snowflake client. It reuses the broker rendezvous and trickle-ICE
+// plumbing from proxy/lib instead of duplicating it, the way external
+// embedders previously had to.
+package snowflake_client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	proxy "git.torproject.org/pluggable-transports/snowflake.git/proxy/lib"
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultMaxPeers is how many WebRTC peers ("snowflakes") the client tries
+// to keep alive at once when SnowflakeClient.Max is left zero. Multiple
+// peers let the client ride out an individual proxy disappearing without
+// losing its turbotunnel session.
+const DefaultMaxPeers = 1
+
+// SnowflakeClient is a structure used to configure an embedded Snowflake
+// client in another Go application, analogous to proxy/lib.SnowflakeProxy on
+// the proxy side.
+type SnowflakeClient struct {
+	BrokerURL          string
+	STUNURL            string
+	KeepLocalAddresses bool
+
+	// BrokerFront and AMPCacheURL mirror proxy/lib.SnowflakeProxy's
+	// fields of the same purpose: reaching the broker when its real
+	// hostname is censored.
+	BrokerFront string
+	AMPCacheURL string
+	// RendezvousMethod overrides how the client exchanges offer/answer
+	// messages with the broker. If nil, one is chosen the same way
+	// proxy/lib.SnowflakeProxy.Start does.
+	RendezvousMethod proxy.RendezvousMethod
+
+	// ICEServers extends the WebRTC configuration beyond STUNURL, for
+	// networks that need a TURN relay to make any progress at all.
+	ICEServers []webrtc.ICEServer
+
+	// Max is how many WebRTC peers to keep alive concurrently. Defaults
+	// to DefaultMaxPeers when zero.
+	Max int
+
+	broker *proxy.SignalingServer
+	config webrtc.Configuration
+	pool   *peerPool
+	tunnel *turbotunnel
+}
+
+// Start resolves the broker and STUN configuration and prepares the peer
+// pool. It must be called before Dial.
+func (sc *SnowflakeClient) Start() error {
+	if sc.Max == 0 {
+		sc.Max = DefaultMaxPeers
+	}
+
+	method := sc.RendezvousMethod
+	if method == nil {
+		switch {
+		case sc.AMPCacheURL != "":
+			method = proxy.NewAMPCacheRendezvous(sc.AMPCacheURL)
+		case sc.BrokerFront != "":
+			method = proxy.NewDomainFrontingRendezvous(sc.BrokerFront)
+		}
+	}
+
+	broker, err := proxy.NewSignalingServer(sc.BrokerURL, sc.KeepLocalAddresses, method)
+	if err != nil {
+		return fmt.Errorf("invalid broker url: %s", err)
+	}
+	sc.broker = broker
+
+	if _, err := url.Parse(sc.STUNURL); err != nil {
+		return fmt.Errorf("invalid stun url: %s", err)
+	}
+	iceServers := append([]webrtc.ICEServer{{URLs: []string{sc.STUNURL}}}, sc.ICEServers...)
+	sc.config = webrtc.Configuration{ICEServers: iceServers}
+
+	sc.pool = newPeerPool(sc.broker, sc.config, sc.Max)
+	sc.tunnel = newTurbotunnel(sc.pool)
+
+	return nil
+}
+
+// Dial opens a new logical stream to the bridge over the client's
+// turbotunnel session, which Start has already set up along with the pool
+// collecting its WebRTC peers. The network and address arguments are ignored; they
+// exist so a SnowflakeClient can be used wherever a net.Dial-shaped func is
+// expected, e.g. as the transport underlying a pt.ClientTransportPlugin.
+func (sc *SnowflakeClient) Dial(network, address string) (net.Conn, error) {
+	return sc.tunnel.openStream()
+}
+
+// Listen is the client-side counterpart conceptually expected of a
+// transport: Snowflake clients don't accept inbound connections, so Listen
+// always returns an error. It exists so SnowflakeClient can satisfy code
+// written against a generic dialer/listener transport interface.
+func (sc *SnowflakeClient) Listen() (net.Listener, error) {
+	return nil, fmt.Errorf("snowflake client: inbound connections are not supported")
+}
+
+// Close tears down the turbotunnel session and every WebRTC peer in the
+// pool.
+func (sc *SnowflakeClient) Close() error {
+	if sc.tunnel != nil {
+		sc.tunnel.Close()
+	}
+	if sc.pool != nil {
+		sc.pool.Close()
+	}
+	return nil
+}
+
+var _ io.Closer = (*SnowflakeClient)(nil)
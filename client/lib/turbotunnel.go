@@ -0,0 +1,194 @@
+package snowflake_client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// turbotunnelMagic and turbotunnelSessionIDLen must match proxy/lib's
+// (unexported) handshake constants of the same name: they identify the
+// bytes a client sends as the very first message on each new peer,
+// before any KCP traffic, so the proxy knows which of the client's
+// (possibly several, concurrently-replaced) peers belong to the same
+// turbotunnel session.
+var turbotunnelMagic = []byte{0x12, 0x93, 0xa1, 0x36, 0x5e, 0x82, 0x30, 0xaf}
+
+const turbotunnelSessionIDLen = 8
+
+// turbotunnel is a single smux session, carrying many logical streams,
+// multiplexed over a peerPool of WebRTC data channels via KCP. Any one
+// peer can disappear and be replaced by the pool without the session
+// noticing, which is the point of turbotunnel: the client's onward
+// connection survives individual proxies coming and going.
+type turbotunnel struct {
+	pool    *peerPool
+	packets *packetConn
+	kcp     *kcp.UDPSession
+	sess    *smux.Session
+}
+
+func newTurbotunnel(pool *peerPool) *turbotunnel {
+	sessionID := make([]byte, turbotunnelSessionIDLen)
+	if _, err := rand.Read(sessionID); err != nil {
+		panic(err.Error())
+	}
+
+	packets := newPacketConn(pool, sessionID)
+	// dataShards and parityShards are 0 because the WebRTC data channel
+	// already gives us a reliable, ordered byte stream per peer; we only
+	// need KCP for the multi-peer multiplexing and smux for multiple
+	// logical streams, not for loss recovery.
+	conn, err := kcp.NewConn2(packets.RemoteAddr(), nil, 0, 0, packets)
+	if err != nil {
+		// packets is only read from and written to after the session
+		// is set up, so this can only happen if kcp-go's own setup
+		// fails.
+		panic(fmt.Sprintf("snowflake_client: kcp.NewConn2: %s", err))
+	}
+	conn.SetStreamMode(true)
+	conn.SetWriteDelay(false)
+
+	smuxConfig := smux.DefaultConfig()
+	sess, err := smux.Client(conn, smuxConfig)
+	if err != nil {
+		panic(fmt.Sprintf("snowflake_client: smux.Client: %s", err))
+	}
+
+	return &turbotunnel{pool: pool, packets: packets, kcp: conn, sess: sess}
+}
+
+// openStream opens a new logical stream over the turbotunnel session.
+func (t *turbotunnel) openStream() (net.Conn, error) {
+	return t.sess.OpenStream()
+}
+
+func (t *turbotunnel) Close() error {
+	if t.sess != nil {
+		t.sess.Close()
+	}
+	if t.kcp != nil {
+		t.kcp.Close()
+	}
+	return nil
+}
+
+// packetAddr is the lone, fixed "address" of the turbotunnel's far end, so
+// kcp-go has something to put in ReadFrom/WriteTo even though the actual
+// routing of packets across peers happens inside packetConn.
+type packetAddr struct{}
+
+func (packetAddr) Network() string { return "snowflake-turbotunnel" }
+func (packetAddr) String() string  { return "snowflake-turbotunnel" }
+
+// packetConn adapts the peerPool to the net.PacketConn interface kcp-go
+// expects: each KCP packet is sent as a length-prefixed message on
+// whichever peer is currently available, handshaking each peer with the
+// session ID before the first packet written to it so the far end can
+// associate them.
+//
+// Reads are fanned in from every live peer concurrently, via one reader
+// goroutine per peer feeding the shared packets channel. Picking a single
+// peer with pool.next() and blocking a read on just that one, as an earlier
+// version of this did, stalls the whole session as soon as more than one
+// peer is active: traffic arriving on any other peer has nobody reading it,
+// which backs up that peer's data channel (dataChannelConn's pipe is
+// unbuffered) indefinitely.
+type packetConn struct {
+	pool      *peerPool
+	sessionID []byte
+
+	mutex  sync.Mutex
+	shaken map[*peer]bool
+
+	packets chan []byte
+}
+
+func newPacketConn(pool *peerPool, sessionID []byte) *packetConn {
+	c := &packetConn{
+		pool:      pool,
+		sessionID: sessionID,
+		shaken:    make(map[*peer]bool),
+		packets:   make(chan []byte, 64),
+	}
+	pool.watch(c.readPeer)
+	return c
+}
+
+// readPeer runs for the lifetime of one peer, decoding its stream of
+// length-prefixed packets and feeding them into the shared packets channel.
+// It returns once pr's data channel closes, at which point the peer pool
+// will have already started collecting pr's replacement and will call
+// readPeer again for it via the watch registered in newPacketConn.
+func (c *packetConn) readPeer(pr *peer) {
+	for {
+		var length uint16
+		if err := binary.Read(pr, binary.BigEndian, &length); err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(pr, packet); err != nil {
+			return
+		}
+		c.packets <- packet
+	}
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		n := copy(b, packet)
+		return n, packetAddr{}, nil
+	case <-c.pool.Done():
+		// Without this case, ReadFrom would block forever once the
+		// pool (and every peer feeding c.packets) is closed, leaking
+		// the goroutine kcp-go blocks in here and potentially hanging
+		// turbotunnel.Close.
+		return 0, nil, fmt.Errorf("snowflake_client: peer pool closed")
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	pr, ok := c.pool.next()
+	if !ok {
+		return 0, fmt.Errorf("snowflake_client: peer pool closed")
+	}
+
+	c.mutex.Lock()
+	needsHandshake := !c.shaken[pr]
+	c.shaken[pr] = true
+	c.mutex.Unlock()
+	if needsHandshake {
+		if _, err := pr.Write(append(append([]byte{}, turbotunnelMagic...), c.sessionID...)); err != nil {
+			return 0, err
+		}
+	}
+
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(b)))
+	if _, err := pr.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := pr.Write(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr  { return packetAddr{} }
+func (c *packetConn) RemoteAddr() net.Addr { return packetAddr{} }
+
+// Close is a no-op: the underlying peers are owned and closed by the
+// peerPool, via SnowflakeClient.Close, not by the KCP/smux layer.
+func (c *packetConn) Close() error { return nil }
+
+func (c *packetConn) SetDeadline(t time.Time) error      { return nil }
+func (c *packetConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *packetConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,74 @@
+package snowflake
+
+import "sync/atomic"
+
+// EventLogger lets an embedder (a mobile UI, a desktop VPN client bundling a
+// proxy) observe a SnowflakeProxy's activity without having to scrape logs,
+// e.g. to display "you've helped N users, moved M bytes".
+type EventLogger interface {
+	// OnClientConnected is called when a client's data channel opens.
+	OnClientConnected(sessionID string)
+	// OnClientDisconnected is called when the proxy is done with a
+	// client, along with a short human-readable reason: either the relay
+	// connection ended, or it could not be set up at all.
+	OnClientDisconnected(sessionID string, reason string)
+	// OnBytesTransferred is called once, when a client's data channel
+	// closes, with that connection's final cumulative inbound/outbound
+	// byte counts. It is not called incrementally during the transfer.
+	OnBytesTransferred(inbound, outbound int64)
+	// OnNATTypeChanged is called whenever checkNATType determines a new
+	// NAT type for this proxy.
+	OnNATTypeChanged(natType string)
+}
+
+// Stats is a snapshot of a SnowflakeProxy's cumulative counters, returned by
+// SnowflakeProxy.Stats.
+type Stats struct {
+	ClientsConnected uint64
+	BytesInbound     int64
+	BytesOutbound    int64
+}
+
+// proxyStats holds the counters backing Stats, updated atomically so they
+// can be read concurrently with datachannelHandler goroutines.
+type proxyStats struct {
+	clientsConnected uint64
+	bytesInbound     int64
+	bytesOutbound    int64
+}
+
+// Stats returns a snapshot of this proxy's cumulative counters.
+func (sf *SnowflakeProxy) Stats() Stats {
+	return Stats{
+		ClientsConnected: atomic.LoadUint64(&sf.stats.clientsConnected),
+		BytesInbound:     atomic.LoadInt64(&sf.stats.bytesInbound),
+		BytesOutbound:    atomic.LoadInt64(&sf.stats.bytesOutbound),
+	}
+}
+
+func (sf *SnowflakeProxy) onClientConnected(sessionID string) {
+	atomic.AddUint64(&sf.stats.clientsConnected, 1)
+	if sf.EventLogger != nil {
+		sf.EventLogger.OnClientConnected(sessionID)
+	}
+}
+
+func (sf *SnowflakeProxy) onClientDisconnected(sessionID string, reason string) {
+	if sf.EventLogger != nil {
+		sf.EventLogger.OnClientDisconnected(sessionID, reason)
+	}
+}
+
+func (sf *SnowflakeProxy) onBytesTransferred(inbound, outbound int64) {
+	atomic.AddInt64(&sf.stats.bytesInbound, inbound)
+	atomic.AddInt64(&sf.stats.bytesOutbound, outbound)
+	if sf.EventLogger != nil {
+		sf.EventLogger.OnBytesTransferred(inbound, outbound)
+	}
+}
+
+func (sf *SnowflakeProxy) onNATTypeChanged(natType string) {
+	if sf.EventLogger != nil {
+		sf.EventLogger.OnNATTypeChanged(natType)
+	}
+}
@@ -0,0 +1,158 @@
+package snowflake
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RendezvousMethod abstracts over the different ways a SnowflakeProxy can
+// exchange poll/answer messages with the broker. It exists so that a proxy
+// can keep working even when the broker's real hostname is blocked, the same
+// way the Snowflake client already copes with a censored broker.
+type RendezvousMethod interface {
+	// Exchange sends payload to url and returns the broker's raw response
+	// body.
+	Exchange(url string, payload []byte) ([]byte, error)
+}
+
+// newRendezvousTransport builds a fresh *http.Transport with the timeout
+// every RendezvousMethod wants, instead of mutating the process-wide
+// http.DefaultTransport: http.DefaultTransport.(*http.Transport) returns the
+// same shared value, not a copy, so writing to it would race with (and
+// silently change the behavior of) any other code in the process using the
+// default transport.
+func newRendezvousTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return transport
+}
+
+// httpRendezvous is the default RendezvousMethod: a plain HTTPS POST to the
+// broker's real URL.
+type httpRendezvous struct {
+	transport http.RoundTripper
+}
+
+func newHTTPRendezvous() *httpRendezvous {
+	return &httpRendezvous{transport: newRendezvousTransport()}
+}
+
+func (r *httpRendezvous) Exchange(urlStr string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", urlStr, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote returned status code %d", resp.StatusCode)
+	}
+	return limitedRead(resp.Body, readLimit)
+}
+
+// domainFrontingRendezvous POSTs to the broker through a domain-fronting
+// front: the TLS connection is made to Front (whose hostname shows up in the
+// SNI and is what a censor sees), while the HTTP Host header carries the
+// broker's real hostname so the CDN routes the request correctly.
+type domainFrontingRendezvous struct {
+	front     string
+	transport http.RoundTripper
+}
+
+// NewDomainFrontingRendezvous constructs a RendezvousMethod that reaches the
+// broker via domain fronting through front. Exported so other packages
+// wired around proxy/lib's SignalingServer, such as the companion client
+// package, can use the same censorship-resistant rendezvous as the proxy.
+func NewDomainFrontingRendezvous(front string) RendezvousMethod {
+	return &domainFrontingRendezvous{front: front, transport: newRendezvousTransport()}
+}
+
+func (r *domainFrontingRendezvous) Exchange(urlStr string, payload []byte) ([]byte, error) {
+	target, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url: %s", err)
+	}
+	realHost := target.Host
+	target.Host = r.front
+
+	req, err := http.NewRequest("POST", target.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	// The Host header is what the CDN uses to decide which backend to
+	// forward to, regardless of what host we actually dialed.
+	req.Host = realHost
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote returned status code %d", resp.StatusCode)
+	}
+	return limitedRead(resp.Body, readLimit)
+}
+
+// ampCacheResponseRegexp extracts the broker's JSON reply out of the
+// AMP-wrapped HTML page an AMP cache returns.
+var ampCacheResponseRegexp = regexp.MustCompile(`(?s)<p class="broker-response">(.*?)</p>`)
+
+// ampCacheRendezvous reaches the broker indirectly through a Google or
+// Cloudflare AMP cache. Since AMP caches only serve GET requests, the poll
+// request is base64-encoded into the cached URL's path rather than sent as a
+// POST body, and the broker's response is parsed back out of the AMP HTML
+// wrapper the cache returns.
+type ampCacheRendezvous struct {
+	ampCacheURL string
+	transport   http.RoundTripper
+}
+
+// NewAMPCacheRendezvous constructs a RendezvousMethod that reaches the
+// broker indirectly through the AMP cache at ampCacheURL. Exported for the
+// same reason as NewDomainFrontingRendezvous.
+func NewAMPCacheRendezvous(ampCacheURL string) RendezvousMethod {
+	return &ampCacheRendezvous{ampCacheURL: ampCacheURL, transport: newRendezvousTransport()}
+}
+
+func (r *ampCacheRendezvous) Exchange(urlStr string, payload []byte) ([]byte, error) {
+	target, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url: %s", err)
+	}
+	encoded := base64.URLEncoding.EncodeToString(payload)
+	cachedURL := strings.TrimRight(r.ampCacheURL, "/") + "/c/s/" + target.Host + target.Path + "/" + encoded
+
+	req, err := http.NewRequest("GET", cachedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("amp cache returned status code %d", resp.StatusCode)
+	}
+
+	body, err := limitedRead(resp.Body, readLimit)
+	if err != nil {
+		return nil, err
+	}
+	match := ampCacheResponseRegexp.FindSubmatch(body)
+	if match == nil {
+		return nil, fmt.Errorf("unable to parse amp cache response")
+	}
+	return match[1], nil
+}
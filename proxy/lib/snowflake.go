@@ -1,7 +1,6 @@
 package snowflake
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
@@ -41,6 +40,13 @@ const DefaultRelayURL = "wss://snowflake.bamsoftware.com/"
 // Changing this will change the default STUN URL. The recommended way of changing
 // the STUN Server that gets used is by passing an argument to Main.
 const DefaultSTUNURL = "stun:stun.stunprotocol.org:3478"
+
+// DefaultProxyType is the default type reported to the broker in poll
+// requests, used when SnowflakeProxy.ProxyType is left empty. Other
+// embedders identify themselves with values such as "webext", "badge",
+// "mobile", or "iptproxy".
+const DefaultProxyType = "standalone"
+
 const pollInterval = 5 * time.Second
 
 const (
@@ -52,28 +58,21 @@ const (
 	NATUnrestricted = "unrestricted"
 )
 
-//amount of time after sending an SDP answer before the proxy assumes the
-//client is not going to connect
+// amount of time after sending an SDP answer before the proxy assumes the
+// client is not going to connect
 const dataChannelTimeout = 20 * time.Second
 
 const readLimit = 100000 //Maximum number of bytes to be read from an HTTP request
 
-var broker *SignalingServer
-
-var currentNATType = NATUnknown
-
 const (
 	sessionIDLength = 16
 )
 
-var (
-	tokens *tokens_t
-	config webrtc.Configuration
-	client http.Client
-)
-
 // SnowflakeProxy is a structure which is used to configure an embedded
-// Snowflake in another Go application.
+// Snowflake in another Go application. Each SnowflakeProxy keeps all of its
+// state to itself, so a single process can run several of them concurrently
+// (for example a VPN client that bundles a proxy alongside its own Snowflake
+// client), each with its own capacity, NAT state, broker, and relay.
 type SnowflakeProxy struct {
 	Capacity           uint
 	StunURL            string
@@ -81,15 +80,75 @@ type SnowflakeProxy struct {
 	KeepLocalAddresses bool
 	RelayURL           string
 	LogOutput          io.Writer
-	shutdown           chan struct{}
+	// ProxyType is reported to the broker in poll requests so it can
+	// distinguish standalone proxies from those embedded in other
+	// software. Defaults to DefaultProxyType when empty.
+	ProxyType string
+
+	// BrokerFront, if set, is the hostname the proxy dials (and presents
+	// in TLS SNI) when talking to the broker, while the real broker
+	// hostname is still sent in the HTTP Host header. This lets the
+	// proxy reach the broker through a domain-fronting CDN when the
+	// broker's own hostname is blocked.
+	BrokerFront string
+	// AMPCacheURL, if set, is the base URL of a Google or Cloudflare AMP
+	// cache used to reach the broker indirectly, for use when both the
+	// broker's hostname and any fronts are blocked.
+	AMPCacheURL string
+	// RendezvousMethod overrides how the proxy exchanges poll/answer
+	// messages with the broker. If nil, one is chosen automatically
+	// based on AMPCacheURL and BrokerFront, falling back to a direct
+	// HTTPS POST.
+	RendezvousMethod RendezvousMethod
+
+	// EnableTurbotunnel turns on turbotunnel-style relaying: data-channel
+	// messages are treated as a client's length-prefixed KCP packets
+	// tagged with a session ID, which is forwarded to the relay as a
+	// session_id query parameter so its turbotunnel.QueuePacketConn can
+	// demultiplex it. This lets a client keep its session when it hops
+	// to a different proxy, which plain byte copying cannot support.
+	EnableTurbotunnel bool
+
+	// EventLogger, if set, is notified of client connections and
+	// disconnections, of each connection's relayed byte totals when it
+	// closes, and of NAT type changes. See Stats for a polling-based
+	// alternative.
+	EventLogger EventLogger
+
+	// NATProbeInterval controls how often the proxy re-runs checkNATType
+	// to account for roaming/mobile proxies changing networks. Defaults
+	// to DefaultNATProbeInterval when zero.
+	NATProbeInterval time.Duration
+	// ICEServers extends the WebRTC configuration beyond the single STUN
+	// URL in StunURL, for operators that need TURN(S) fallbacks for
+	// proxies behind a restrictive NAT.
+	ICEServers []webrtc.ICEServer
+
+	shutdown             chan struct{}
+	broker               *SignalingServer
+	tokens               *tokens_t
+	config               webrtc.Configuration
+	client               http.Client
+	natTypeMutex         sync.Mutex
+	currentNATType       string
+	stats                proxyStats
+	pendingSessionsMutex sync.Mutex
+	pendingSessions      map[string]chan struct{}
 }
 
+// DefaultNATProbeInterval is how often Start re-checks the proxy's NAT type
+// when SnowflakeProxy.NATProbeInterval is left zero.
+const DefaultNATProbeInterval = time.Hour
+
 // Checks whether an IP address is a remote address for the client
 func isRemoteAddress(ip net.IP) bool {
 	return !(util.IsLocal(ip) || ip.IsUnspecified() || ip.IsLoopback())
 }
 
-func genSessionID() string {
+// GenSessionID returns a fresh, random session ID suitable for identifying
+// a proxy-broker or client-broker exchange. Exported so the companion
+// client package can generate session IDs the same way the proxy does.
+func GenSessionID() string {
 	buf := make([]byte, sessionIDLength)
 	_, err := rand.Read(buf)
 	if err != nil {
@@ -111,11 +170,15 @@ func limitedRead(r io.Reader, limit int64) ([]byte, error) {
 // SignalingServer keeps track of the SignalingServer in use by the Snowflake
 type SignalingServer struct {
 	url                *url.URL
-	transport          http.RoundTripper
+	method             RendezvousMethod
 	keepLocalAddresses bool
 }
 
-func newSignalingServer(rawURL string, keepLocalAddresses bool) (*SignalingServer, error) {
+// NewSignalingServer constructs a SignalingServer for rawURL, using method
+// to exchange messages with it (falling back to a direct HTTPS POST when
+// method is nil). It is exported so the companion client package can talk
+// to the same broker through the same rendezvous methods as the proxy.
+func NewSignalingServer(rawURL string, keepLocalAddresses bool, method RendezvousMethod) (*SignalingServer, error) {
 	var err error
 	s := new(SignalingServer)
 	s.keepLocalAddresses = keepLocalAddresses
@@ -124,33 +187,30 @@ func newSignalingServer(rawURL string, keepLocalAddresses bool) (*SignalingServe
 		return nil, fmt.Errorf("invalid broker url: %s", err)
 	}
 
-	s.transport = http.DefaultTransport.(*http.Transport)
-	s.transport.(*http.Transport).ResponseHeaderTimeout = 30 * time.Second
+	if method == nil {
+		method = newHTTPRendezvous()
+	}
+	s.method = method
 
 	return s, nil
 }
 
 // Post sends a POST request to the SignalingServer
-func (s *SignalingServer) Post(path string, payload io.Reader) ([]byte, error) {
-
-	req, err := http.NewRequest("POST", path, payload)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := s.transport.RoundTrip(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("remote returned status code %d", resp.StatusCode)
-	}
+func (s *SignalingServer) Post(path string, payload []byte) ([]byte, error) {
+	return s.method.Exchange(path, payload)
+}
 
-	defer resp.Body.Close()
-	return limitedRead(resp.Body, readLimit)
+// Exchange resolves relPath (e.g. "proxy", "answer", "client") against the
+// broker's base URL and exchanges payload with it using the configured
+// RendezvousMethod. It is exported so that other packages built around a
+// SignalingServer, such as the companion client package, aren't forced to
+// duplicate broker-URL handling.
+func (s *SignalingServer) Exchange(relPath string, payload []byte) ([]byte, error) {
+	target := s.url.ResolveReference(&url.URL{Path: relPath})
+	return s.Post(target.String(), payload)
 }
 
-func (s *SignalingServer) pollOffer(sid string, shutdown chan struct{}) *webrtc.SessionDescription {
+func (s *SignalingServer) pollOffer(sid string, proxyType string, natType string, numClients int, shutdown chan struct{}, cancel chan struct{}) *webrtc.SessionDescription {
 	brokerPath := s.url.ResolveReference(&url.URL{Path: "proxy"})
 
 	ticker := time.NewTicker(pollInterval)
@@ -161,14 +221,16 @@ func (s *SignalingServer) pollOffer(sid string, shutdown chan struct{}) *webrtc.
 		select {
 		case <-shutdown:
 			return nil
+		case <-cancel:
+			log.Printf("session %s dropped while queued", sid)
+			return nil
 		default:
-			numClients := int((tokens.count() / 8) * 8) // Round down to 8
-			body, err := messages.EncodePollRequest(sid, "standalone", currentNATType, numClients)
+			body, err := messages.EncodePollRequest(sid, proxyType, natType, numClients)
 			if err != nil {
 				log.Printf("Error encoding poll message: %s", err.Error())
 				return nil
 			}
-			resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
+			resp, err := s.Post(brokerPath.String(), body)
 			if err != nil {
 				log.Printf("error polling broker: %s", err.Error())
 			}
@@ -210,7 +272,7 @@ func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) erro
 	if err != nil {
 		return err
 	}
-	resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
+	resp, err := s.Post(brokerPath.String(), body)
 	if err != nil {
 		return fmt.Errorf("error sending answer to broker: %s", err.Error())
 	}
@@ -256,34 +318,53 @@ func copyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct
 // conn.RemoteAddr() inside this function, as a workaround for a hang that
 // otherwise occurs inside of conn.pc.RemoteDescription() (called by
 // RemoteAddr). https://bugs.torproject.org/18628#comment:8
-func (sf *SnowflakeProxy) datachannelHandler(conn *webRTCConn, remoteAddr net.Addr) {
+func (sf *SnowflakeProxy) datachannelHandler(conn *webRTCConn, remoteAddr net.Addr, sessionID string) {
 	defer conn.Close()
-	defer tokens.ret()
+	defer sf.tokens.ret()
+
+	sf.onClientConnected(sessionID)
+	reason := "completed"
+	defer func() { sf.onClientDisconnected(sessionID, reason) }()
 
 	u, err := url.Parse(sf.RelayURL)
 	if err != nil {
 		log.Fatalf("invalid relay url: %s", err)
 	}
 
+	q := u.Query()
 	if remoteAddr != nil {
 		// Encode client IP address in relay URL
-		q := u.Query()
-		clientIP := remoteAddr.String()
-		q.Set("client_ip", clientIP)
-		u.RawQuery = q.Encode()
+		q.Set("client_ip", remoteAddr.String())
 	} else {
 		log.Printf("no remote address given in websocket")
 	}
 
+	// relayConn is what gets streamed to the relay. In turbotunnel mode it
+	// still starts with the handshake bytes consumed below, so the KCP
+	// packet framing the client sent is preserved end to end.
+	var relayConn io.ReadWriteCloser = conn
+	if sf.EnableTurbotunnel {
+		ttSessionID, handshake, err := readTurbotunnelHandshake(conn)
+		if err != nil {
+			reason = "turbotunnel handshake error"
+			log.Printf("error reading turbotunnel handshake: %s", err)
+			return
+		}
+		q.Set("session_id", ttSessionID)
+		relayConn = newPrefixedConn(handshake, conn)
+	}
+	u.RawQuery = q.Encode()
+
 	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
+		reason = "relay dial error"
 		log.Printf("error dialing relay: %s", err)
 		return
 	}
 	wsConn := websocketconn.New(ws)
 	log.Printf("connected to relay")
 	defer wsConn.Close()
-	copyLoop(conn, wsConn, sf.shutdown)
+	copyLoop(relayConn, wsConn, sf.shutdown)
 	log.Printf("datachannelHandler ends")
 }
 
@@ -294,7 +375,8 @@ func (sf *SnowflakeProxy) datachannelHandler(conn *webRTCConn, remoteAddr net.Ad
 func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescription,
 	config webrtc.Configuration,
 	dataChan chan struct{},
-	handler func(conn *webRTCConn, remoteAddr net.Addr)) (*webrtc.PeerConnection, error) {
+	sessionID string,
+	handler func(conn *webRTCConn, remoteAddr net.Addr, sessionID string)) (*webrtc.PeerConnection, error) {
 
 	pc, err := webrtc.NewPeerConnection(config)
 	if err != nil {
@@ -316,6 +398,7 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescrip
 			defer conn.lock.Unlock()
 			log.Println("OnClose channel")
 			log.Println(conn.bytesLogger.ThroughputSummary())
+			sf.onBytesTransferred(conn.bytesLogger.Inbound, conn.bytesLogger.Outbound)
 			conn.dc = nil
 			dc.Close()
 			pw.Close()
@@ -334,7 +417,7 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescrip
 			}
 		})
 
-		go handler(conn, conn.RemoteAddr())
+		go handler(conn, conn.RemoteAddr(), sessionID)
 	})
 	// As of v3.0.0, pion-webrtc uses trickle ICE by default.
 	// We have to wait for candidate gathering to complete
@@ -377,10 +460,24 @@ func (sf *SnowflakeProxy) makePeerConnectionFromOffer(sdp *webrtc.SessionDescrip
 // candidates is complete and the answer is available in LocalDescription.
 func (sf *SnowflakeProxy) makeNewPeerConnection(config webrtc.Configuration,
 	dataChan chan struct{}) (*webrtc.PeerConnection, error) {
+	pc, _, err := NewTricklePeerConnection(config, dataChan)
+	return pc, err
+}
+
+// NewTricklePeerConnection creates a PeerConnection with a single "test"
+// data channel and an SDP offer, and blocks until ICE candidate gathering
+// completes so the returned PeerConnection's LocalDescription already
+// carries the full candidate list. dataChan is closed once the data channel
+// opens. It underlies both the proxy's NAT check and the companion client's
+// peer setup, so the two sides don't each reimplement pion's trickle-ICE
+// gathering dance; the client additionally needs the returned DataChannel
+// itself to carry traffic once it opens, which the NAT check ignores.
+func NewTricklePeerConnection(config webrtc.Configuration,
+	dataChan chan struct{}) (*webrtc.PeerConnection, *webrtc.DataChannel, error) {
 
 	pc, err := webrtc.NewPeerConnection(config)
 	if err != nil {
-		return nil, fmt.Errorf("accept: NewPeerConnection: %s", err)
+		return nil, nil, fmt.Errorf("accept: NewPeerConnection: %s", err)
 	}
 
 	// Must create a data channel before creating an offer
@@ -388,7 +485,7 @@ func (sf *SnowflakeProxy) makeNewPeerConnection(config webrtc.Configuration,
 	dc, err := pc.CreateDataChannel("test", &webrtc.DataChannelInit{})
 	if err != nil {
 		log.Printf("CreateDataChannel ERROR: %s", err)
-		return nil, err
+		return nil, nil, err
 	}
 	dc.OnOpen(func() {
 		log.Println("WebRTC: DataChannel.OnOpen")
@@ -404,7 +501,7 @@ func (sf *SnowflakeProxy) makeNewPeerConnection(config webrtc.Configuration,
 	if err != nil {
 		log.Println("Failed to prepare offer", err)
 		pc.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	log.Println("WebRTC: Created offer")
 
@@ -416,36 +513,117 @@ func (sf *SnowflakeProxy) makeNewPeerConnection(config webrtc.Configuration,
 	if err != nil {
 		log.Println("Failed to prepare offer", err)
 		pc.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	log.Println("WebRTC: Set local description")
 
 	// Wait for ICE candidate gathering to complete
 	<-done
-	return pc, nil
+	return pc, dc, nil
+}
+
+// registerPendingSession records sid as waiting on the broker for an offer
+// and returns the channel that natProbeLoop closes to drop it early if the
+// proxy's NAT type degrades while the session is still queued.
+func (sf *SnowflakeProxy) registerPendingSession(sid string) chan struct{} {
+	cancel := make(chan struct{})
+	sf.pendingSessionsMutex.Lock()
+	defer sf.pendingSessionsMutex.Unlock()
+	if sf.pendingSessions == nil {
+		sf.pendingSessions = make(map[string]chan struct{})
+	}
+	sf.pendingSessions[sid] = cancel
+	return cancel
+}
+
+func (sf *SnowflakeProxy) unregisterPendingSession(sid string) {
+	sf.pendingSessionsMutex.Lock()
+	defer sf.pendingSessionsMutex.Unlock()
+	delete(sf.pendingSessions, sid)
+}
+
+// dropPendingSessions cancels every session still queued waiting on the
+// broker. It's called when the proxy's NAT type goes from unrestricted to
+// restricted, since those sessions are unlikely to ever connect.
+func (sf *SnowflakeProxy) dropPendingSessions() {
+	sf.pendingSessionsMutex.Lock()
+	defer sf.pendingSessionsMutex.Unlock()
+	for sid, cancel := range sf.pendingSessions {
+		close(cancel)
+		delete(sf.pendingSessions, sid)
+	}
+}
+
+// natType returns the proxy's current NAT type. It's safe to call
+// concurrently with setNATType, since checkNATType runs both from Start and,
+// periodically, from natProbeLoop.
+func (sf *SnowflakeProxy) natType() string {
+	sf.natTypeMutex.Lock()
+	defer sf.natTypeMutex.Unlock()
+	return sf.currentNATType
+}
+
+func (sf *SnowflakeProxy) setNATType(natType string) {
+	sf.natTypeMutex.Lock()
+	defer sf.natTypeMutex.Unlock()
+	sf.currentNATType = natType
+}
+
+// natProbeLoop periodically re-runs checkNATType so that roaming or mobile
+// proxies pick up NAT changes caused by switching networks, instead of
+// being stuck with whatever NAT type Start saw at startup.
+func (sf *SnowflakeProxy) natProbeLoop() {
+	interval := sf.NATProbeInterval
+	if interval == 0 {
+		interval = DefaultNATProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sf.shutdown:
+			return
+		case <-ticker.C:
+			previous := sf.natType()
+			sf.checkNATType(sf.config, DefaultProbeURL)
+			current := sf.natType()
+			if current == previous {
+				continue
+			}
+			log.Printf("NAT type changed: %s -> %s", previous, current)
+			if previous == NATUnrestricted && current == NATRestricted {
+				sf.dropPendingSessions()
+			}
+		}
+	}
 }
 
 func (sf *SnowflakeProxy) runSession(sid string) {
-	offer := broker.pollOffer(sid, sf.shutdown)
+	cancel := sf.registerPendingSession(sid)
+	defer sf.unregisterPendingSession(sid)
+
+	numClients := int((sf.tokens.count() / 8) * 8) // Round down to 8
+	offer := sf.broker.pollOffer(sid, sf.ProxyType, sf.natType(), numClients, sf.shutdown, cancel)
 	if offer == nil {
 		log.Printf("bad offer from broker")
-		tokens.ret()
+		sf.tokens.ret()
 		return
 	}
 	dataChan := make(chan struct{})
-	pc, err := sf.makePeerConnectionFromOffer(offer, config, dataChan, sf.datachannelHandler)
+	pc, err := sf.makePeerConnectionFromOffer(offer, sf.config, dataChan, sid, sf.datachannelHandler)
 	if err != nil {
 		log.Printf("error making WebRTC connection: %s", err)
-		tokens.ret()
+		sf.tokens.ret()
 		return
 	}
-	err = broker.sendAnswer(sid, pc)
+	err = sf.broker.sendAnswer(sid, pc)
 	if err != nil {
 		log.Printf("error sending answer to client through broker: %s", err)
 		if inerr := pc.Close(); inerr != nil {
 			log.Printf("error calling pc.Close: %v", inerr)
 		}
-		tokens.ret()
+		sf.tokens.ret()
 		return
 	}
 	// Set a timeout on peerconnection. If the connection state has not
@@ -459,7 +637,7 @@ func (sf *SnowflakeProxy) runSession(sid string) {
 		if err := pc.Close(); err != nil {
 			log.Printf("error calling pc.Close: %v", err)
 		}
-		tokens.ret()
+		sf.tokens.ret()
 	}
 }
 
@@ -474,8 +652,24 @@ func (sf *SnowflakeProxy) Start() {
 
 	log.Println("starting")
 
+	if sf.ProxyType == "" {
+		sf.ProxyType = DefaultProxyType
+	}
+
+	sf.setNATType(NATUnknown)
+
+	method := sf.RendezvousMethod
+	switch {
+	case method != nil:
+		// use the caller-provided method as-is
+	case sf.AMPCacheURL != "":
+		method = NewAMPCacheRendezvous(sf.AMPCacheURL)
+	case sf.BrokerFront != "":
+		method = NewDomainFrontingRendezvous(sf.BrokerFront)
+	}
+
 	var err error
-	broker, err = newSignalingServer(sf.RawBrokerURL, sf.KeepLocalAddresses)
+	sf.broker, err = NewSignalingServer(sf.RawBrokerURL, sf.KeepLocalAddresses, method)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -488,19 +682,22 @@ func (sf *SnowflakeProxy) Start() {
 	if err != nil {
 		log.Fatalf("invalid relay url: %s", err)
 	}
+	for _, iceServer := range sf.ICEServers {
+		if len(iceServer.URLs) == 0 {
+			log.Fatalf("invalid ICE server: missing URL")
+		}
+	}
 
-	config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{sf.StunURL},
-			},
-		},
+	iceServers := append([]webrtc.ICEServer{{URLs: []string{sf.StunURL}}}, sf.ICEServers...)
+	sf.config = webrtc.Configuration{
+		ICEServers: iceServers,
 	}
-	tokens = newTokens(sf.Capacity)
+	sf.tokens = newTokens(sf.Capacity)
 
 	// use probetest to determine NAT compatability
-	sf.checkNATType(config, DefaultProbeURL)
-	log.Printf("NAT type: %s", currentNATType)
+	sf.checkNATType(sf.config, DefaultProbeURL)
+	log.Printf("NAT type: %s", sf.natType())
+	go sf.natProbeLoop()
 
 	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
@@ -510,8 +707,8 @@ func (sf *SnowflakeProxy) Start() {
 		case <-sf.shutdown:
 			return
 		default:
-			tokens.get()
-			sessionID := genSessionID()
+			sf.tokens.get()
+			sessionID := GenSessionID()
 			sf.runSession(sessionID)
 		}
 	}
@@ -524,7 +721,7 @@ func (sf *SnowflakeProxy) Stop() {
 
 func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL string) {
 
-	probe, err := newSignalingServer(probeURL, false)
+	probe, err := NewSignalingServer(probeURL, false, nil)
 	if err != nil {
 		log.Printf("Error parsing url: %s", err.Error())
 	}
@@ -551,7 +748,7 @@ func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL str
 		log.Printf("Error encoding probe message: %s", err.Error())
 		return
 	}
-	resp, err := probe.Post(probe.url.String(), bytes.NewBuffer(body))
+	resp, err := probe.Post(probe.url.String(), body)
 	if err != nil {
 		log.Printf("error polling probe: %s", err.Error())
 		return
@@ -573,14 +770,18 @@ func (sf *SnowflakeProxy) checkNATType(config webrtc.Configuration, probeURL str
 		return
 	}
 
+	previous := sf.natType()
 	select {
 	case <-dataChan:
-		currentNATType = NATUnrestricted
+		sf.setNATType(NATUnrestricted)
 	case <-time.After(dataChannelTimeout):
-		currentNATType = NATRestricted
+		sf.setNATType(NATRestricted)
+	}
+	if current := sf.natType(); current != previous {
+		sf.onNATTypeChanged(current)
 	}
 	if err := pc.Close(); err != nil {
 		log.Printf("error calling pc.Close: %v", err)
 	}
 
-}
\ No newline at end of file
+}
@@ -0,0 +1,53 @@
+package snowflake
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// turbotunnelMagic is the fixed prefix of the handshake a turbotunnel client
+// sends as the very first data-channel message, identifying the stream that
+// follows as length-prefixed KCP packets rather than a raw byte stream. It
+// is immediately followed by an 8-byte client session ID.
+var turbotunnelMagic = []byte{0x12, 0x93, 0xa1, 0x36, 0x5e, 0x82, 0x30, 0xaf}
+
+const turbotunnelSessionIDLen = 8
+
+// prefixedConn is an io.ReadWriteCloser that replays prefix before reading
+// further data from the wrapped connection, while writes and closes go
+// straight through. It lets datachannelHandler peek at a turbotunnel
+// handshake and then hand the relay connection a reader that still includes
+// the bytes it consumed while peeking.
+type prefixedConn struct {
+	r io.Reader
+	io.WriteCloser
+}
+
+func newPrefixedConn(prefix []byte, conn io.ReadWriteCloser) *prefixedConn {
+	return &prefixedConn{
+		r:           io.MultiReader(bytes.NewReader(prefix), conn),
+		WriteCloser: conn,
+	}
+}
+
+func (p *prefixedConn) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// readTurbotunnelHandshake reads the turbotunnel handshake off conn and
+// returns the client's session ID in hex along with the handshake bytes so
+// the caller can still forward them to the relay. If the first bytes are not
+// a turbotunnel handshake it returns an error, and the bytes it read are not
+// returned.
+func readTurbotunnelHandshake(conn io.Reader) (sessionID string, handshake []byte, err error) {
+	handshake = make([]byte, len(turbotunnelMagic)+turbotunnelSessionIDLen)
+	if _, err = io.ReadFull(conn, handshake); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(handshake[:len(turbotunnelMagic)], turbotunnelMagic) {
+		return "", nil, fmt.Errorf("missing turbotunnel handshake")
+	}
+	return hex.EncodeToString(handshake[len(turbotunnelMagic):]), handshake, nil
+}